@@ -7,7 +7,9 @@ import (
     "strconv"
     "io/ioutil"
     "path"
+    "path/filepath"
     "encoding/json"
+    "syscall"
 
     "github.com/docker/go-plugins-helpers/volume"
     "github.com/docker/engine-api/client"
@@ -28,37 +30,79 @@ var (
 
 type localPersistDriver struct {
     volumes    map[string]string
+    refs       map[string]map[string]bool
+    opts       map[string]volumeOptions
+    templates  map[string]string
     mutex      *sync.Mutex
     debug      bool
     name       string
     baseDir    string
     stateDir   string
+    scope      string
+    allowedPaths []string
 }
 
+// volumeOptions holds the `Create` options that go beyond `mountpoint`. Type is
+// either "bind" (the default - a plain host directory) or "tmpfs", mounted and
+// unmounted as the volume's refcount becomes non-zero/zero. UID/GID default to -1,
+// the POSIX chown "leave unchanged" sentinel, so passing only one of the pair
+// doesn't reset the other to root.
+type volumeOptions struct {
+    UID  int    `json:"uid"`
+    GID  int    `json:"gid"`
+    Mode string `json:"mode,omitempty"`
+    Size string `json:"size,omitempty"`
+    Type string `json:"type,omitempty"`
+}
+
+var allowedCreateOptions = map[string]bool{
+    "mountpoint" : true,
+    "uid"        : true,
+    "gid"        : true,
+    "mode"       : true,
+    "size"       : true,
+    "type"       : true,
+}
+
+// Version 5 changed `state` to hold each volume's fully-resolved absolute mountpoint
+// instead of the bare `mountpoint` option joined against baseDir on every use.
+const currentStateVersion = 5
+
 type saveData struct {
-    State map[string]string `json:"state"`
+    Version   int                          `json:"version"`
+    State     map[string]string            `json:"state"`
+    Refs      map[string]map[string]bool   `json:"refs"`
+    Opts      map[string]volumeOptions     `json:"opts"`
+    Templates map[string]string            `json:"templates"`
 }
 
-func newLocalPersistDriver(name string, baseDir string, stateDir string, debug bool) localPersistDriver {
+func newLocalPersistDriver(name string, baseDir string, stateDir string, scope string, allowedPaths []string, debug bool) localPersistDriver {
     if(debug) {
         fmt.Printf(white("%-18s", "Starting... "))
     }
     driver := localPersistDriver{
-        volumes  : map[string]string{},
-        mutex    : &sync.Mutex{},
-        debug    : debug,
-        name     : name,
-        baseDir  : baseDir,
-        stateDir : stateDir,
+        volumes      : map[string]string{},
+        refs         : map[string]map[string]bool{},
+        opts         : map[string]volumeOptions{},
+        templates    : map[string]string{},
+        mutex        : &sync.Mutex{},
+        debug        : debug,
+        name         : name,
+        baseDir      : baseDir,
+        stateDir     : stateDir,
+        scope        : scope,
+        allowedPaths : allowedPaths,
     }
 
     os.Mkdir(stateDir, 0700)
 
-    _, driver.volumes = driver.findExistingVolumesFromStateFile()
+    _, driver.volumes, driver.refs, driver.opts, driver.templates = driver.findExistingVolumesFromStateFile()
     if(driver.debug) {
         fmt.Printf("Found %s volumes on startup\n", yellow(strconv.Itoa(len(driver.volumes))))
     }
 
+    driver.reconcileRefsFromDockerDaemon()
+
     return driver
 }
 
@@ -105,12 +149,30 @@ func (driver localPersistDriver) Create(req volume.Request) volume.Response {
         fmt.Print(white("%-18s", "Create Called... "))
     }
 
-    mountpoint := req.Options["mountpoint"]
-    if mountpoint == "" {
+    for key := range req.Options {
+        if !allowedCreateOptions[key] {
+            return volume.Response{ Err: fmt.Sprintf("Unknown option %s", blue(key)) }
+        }
+    }
+
+    mountpointTemplate := req.Options["mountpoint"]
+    if mountpointTemplate == "" {
         fmt.Printf("No %s option provided\n", blue("mountpoint"))
         return volume.Response{ Err: fmt.Sprintf("The `mountpoint` option is required") }
     }
-    realMountpoint := path.Join(driver.baseDir, mountpoint)
+    mountpoint, err := resolveMountpointTemplate(mountpointTemplate, req.Name)
+    if err != nil {
+        return volume.Response{ Err: err.Error() }
+    }
+    realMountpoint, err := driver.resolveSafeMountpoint(mountpoint)
+    if err != nil {
+        return volume.Response{ Err: err.Error() }
+    }
+
+    opts, err := parseVolumeOptions(req.Options)
+    if err != nil {
+        return volume.Response{ Err: err.Error() }
+    }
 
     driver.mutex.Lock()
     defer driver.mutex.Unlock()
@@ -119,7 +181,7 @@ func (driver localPersistDriver) Create(req volume.Request) volume.Response {
         return volume.Response{ Err: fmt.Sprintf("The volume %s already exists", req.Name) }
     }
 
-    err := os.MkdirAll(realMountpoint, 0755)
+    err = os.MkdirAll(realMountpoint, 0755)
     if(driver.debug) {
         fmt.Printf("Ensuring directory %s exists on host...\n", magenta(realMountpoint))
     }
@@ -128,8 +190,16 @@ func (driver localPersistDriver) Create(req volume.Request) volume.Response {
         return volume.Response{ Err: err.Error() }
     }
 
-    driver.volumes[req.Name] = mountpoint
-    e := driver.saveState(driver.volumes)
+    if err := applyVolumeOwnership(realMountpoint, opts); err != nil {
+        return volume.Response{ Err: err.Error() }
+    }
+
+    driver.volumes[req.Name] = realMountpoint
+    driver.opts[req.Name] = opts
+    if mountpointTemplate != mountpoint {
+        driver.templates[req.Name] = mountpointTemplate
+    }
+    e := driver.saveState()
     if e != nil {
         fmt.Println(e.Error())
     }
@@ -140,6 +210,74 @@ func (driver localPersistDriver) Create(req volume.Request) volume.Response {
     return volume.Response{}
 }
 
+// parseVolumeOptions validates the subset of `Create`'s options that configure
+// ownership/permissions/backing store, defaulting Type to "bind" (a plain host
+// directory). `size` is only meaningful for `type=tmpfs`, where it's passed straight
+// through as a tmpfs mount option.
+func parseVolumeOptions(options map[string]string) (volumeOptions, error) {
+    opts := volumeOptions{
+        UID  : -1,
+        GID  : -1,
+        Mode : options["mode"],
+        Size : options["size"],
+        Type : options["type"],
+    }
+
+    if opts.Type == "" {
+        opts.Type = "bind"
+    }
+    if opts.Type != "bind" && opts.Type != "tmpfs" {
+        return opts, fmt.Errorf("Unsupported `type` option %s, must be `bind` or `tmpfs`", opts.Type)
+    }
+    if opts.Size != "" && opts.Type != "tmpfs" {
+        return opts, fmt.Errorf("The `size` option is only supported with `type=tmpfs`")
+    }
+
+    if uid := options["uid"]; uid != "" {
+        parsed, err := strconv.Atoi(uid)
+        if err != nil {
+            return opts, fmt.Errorf("Invalid `uid` option %s", uid)
+        }
+        opts.UID = parsed
+    }
+    if gid := options["gid"]; gid != "" {
+        parsed, err := strconv.Atoi(gid)
+        if err != nil {
+            return opts, fmt.Errorf("Invalid `gid` option %s", gid)
+        }
+        opts.GID = parsed
+    }
+    if opts.Mode != "" {
+        if _, err := strconv.ParseUint(opts.Mode, 8, 32); err != nil {
+            return opts, fmt.Errorf("Invalid `mode` option %s", opts.Mode)
+        }
+    }
+
+    return opts, nil
+}
+
+// applyVolumeOwnership chowns/chmods realMountpoint per opts. It's called both right
+// after `Create` makes the directory and after a `tmpfs` mount on first `Mount`, since
+// mounting tmpfs gives the root of the new mount its own default ownership/mode,
+// shadowing whatever was applied to the (now hidden) directory underneath.
+func applyVolumeOwnership(realMountpoint string, opts volumeOptions) error {
+    if opts.UID != -1 || opts.GID != -1 {
+        if err := os.Chown(realMountpoint, opts.UID, opts.GID); err != nil {
+            return err
+        }
+    }
+    if opts.Mode != "" {
+        mode, err := strconv.ParseUint(opts.Mode, 8, 32)
+        if err != nil {
+            return fmt.Errorf("Invalid `mode` option %s", opts.Mode)
+        }
+        if err := os.Chmod(realMountpoint, os.FileMode(mode)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
 func (driver localPersistDriver) Remove(req volume.Request) volume.Response {
     if(driver.debug) {
         fmt.Print(white("%-18s", "Remove Called... "))
@@ -147,9 +285,19 @@ func (driver localPersistDriver) Remove(req volume.Request) volume.Response {
     driver.mutex.Lock()
     defer driver.mutex.Unlock()
 
+    if len(driver.refs[req.Name]) > 0 {
+        if(driver.debug) {
+            fmt.Printf("Volume %s is in use\n", cyan(req.Name))
+        }
+        return volume.Response{ Err: fmt.Sprintf("volume %s is in use", cyan(req.Name)) }
+    }
+
     delete(driver.volumes, req.Name)
+    delete(driver.refs, req.Name)
+    delete(driver.opts, req.Name)
+    delete(driver.templates, req.Name)
 
-    err := driver.saveState(driver.volumes)
+    err := driver.saveState()
     if err != nil {
         fmt.Println(err.Error())
     }
@@ -164,8 +312,42 @@ func (driver localPersistDriver) Remove(req volume.Request) volume.Response {
 func (driver localPersistDriver) Mount(req volume.Request) volume.Response {
     if(driver.debug) {
         fmt.Print(white("%-18s", "Mount Called... "))
+    }
+
+    driver.mutex.Lock()
+    defer driver.mutex.Unlock()
 
-        fmt.Printf("Mounted %s\n", cyan(req.Name))
+    firstRef := len(driver.refs[req.Name]) == 0
+    if driver.refs[req.Name] == nil {
+        driver.refs[req.Name] = map[string]bool{}
+    }
+    driver.refs[req.Name][req.ID] = true
+
+    if firstRef && driver.opts[req.Name].Type == "tmpfs" {
+        realMountpoint := driver.volumes[req.Name]
+        opts := driver.opts[req.Name]
+        data := ""
+        if opts.Size != "" {
+            data = "size=" + opts.Size
+        }
+        if err := syscall.Mount("tmpfs", realMountpoint, "tmpfs", 0, data); err != nil {
+            delete(driver.refs[req.Name], req.ID)
+            return volume.Response{ Err: err.Error() }
+        }
+        if err := applyVolumeOwnership(realMountpoint, opts); err != nil {
+            syscall.Unmount(realMountpoint, 0)
+            delete(driver.refs[req.Name], req.ID)
+            return volume.Response{ Err: err.Error() }
+        }
+    }
+
+    e := driver.saveState()
+    if e != nil {
+        fmt.Println(e.Error())
+    }
+
+    if(driver.debug) {
+        fmt.Printf("Mounted %s for id %s\n", cyan(req.Name), req.ID)
     }
     return driver.Path(req)
 }
@@ -176,20 +358,52 @@ func (driver localPersistDriver) Path(req volume.Request) volume.Response {
 
         fmt.Printf("Returned path %s\n", magenta(driver.volumes[req.Name]))
     }
-    return volume.Response{ Mountpoint: path.Join(driver.baseDir, driver.volumes[req.Name]) }
+    return volume.Response{ Mountpoint: driver.volumes[req.Name] }
 }
 
 func (driver localPersistDriver) Unmount(req volume.Request) volume.Response {
-    if(driver.debug) {        
+    if(driver.debug) {
         fmt.Print(white("%-18s", "Unmount Called... "))
+    }
 
-        fmt.Printf("Unmounted %s\n", cyan(req.Name))
+    driver.mutex.Lock()
+    defer driver.mutex.Unlock()
+
+    delete(driver.refs[req.Name], req.ID)
+    if len(driver.refs[req.Name]) == 0 {
+        delete(driver.refs, req.Name)
+
+        if driver.opts[req.Name].Type == "tmpfs" {
+            realMountpoint := driver.volumes[req.Name]
+            if err := syscall.Unmount(realMountpoint, 0); err != nil {
+                fmt.Println(err.Error())
+            }
+        }
+    }
+
+    e := driver.saveState()
+    if e != nil {
+        fmt.Println(e.Error())
+    }
+
+    if(driver.debug) {
+        fmt.Printf("Unmounted %s for id %s\n", cyan(req.Name), req.ID)
     }
 
     return driver.Path(req)
 }
 
 
+func (driver localPersistDriver) Capabilities(req volume.Request) volume.Response {
+    if(driver.debug) {
+        fmt.Printf(white("%-18s", "Capabilities Called... "))
+        fmt.Printf("Advertised scope %s\n", yellow(driver.scope))
+    }
+    return volume.Response{
+        Capabilities: volume.Capability{ Scope: driver.scope },
+    }
+}
+
 func (driver localPersistDriver) exists(name string) bool {
     return driver.volumes[name] != ""
 }
@@ -201,13 +415,13 @@ func (driver localPersistDriver) volume(name string) *volume.Volume {
     }
 }
 
-func (driver localPersistDriver) findExistingVolumesFromDockerDaemon() (error, map[string]string) {
+func (driver localPersistDriver) findExistingVolumesFromDockerDaemon() (error, map[string]string, map[string]map[string]bool) {
     // set up the ability to make API calls to the daemon
     defaultHeaders := map[string]string{"User-Agent": "engine-api-cli-1.0"}
     // need at least Docker 1.9 (API v1.21) for named Volume support
     cli, err := client.NewClient("unix:///var/run/docker.sock", "v1.21", nil, defaultHeaders)
     if err != nil {
-        return err, map[string]string{}
+        return err, map[string]string{}, map[string]map[string]bool{}
     }
 
     // grab ALL containers...
@@ -216,6 +430,7 @@ func (driver localPersistDriver) findExistingVolumesFromDockerDaemon() (error, m
 
     // ...and check to see if any of them belong to this driver and recreate their references
     var volumes = map[string]string{}
+    var refs = map[string]map[string]bool{}
     for _, container := range containers {
         info, err := cli.ContainerInspect(context.Background(), container.ID)
         if err != nil {
@@ -229,6 +444,16 @@ func (driver localPersistDriver) findExistingVolumesFromDockerDaemon() (error, m
                 // what if they is the same name with a different source? could that happen? if it could,
                 // it'd be bad, so maybe we want to panic here?
                 volumes[mount.Name] = mount.Source
+
+                // Only running containers are still holding the volume open - a stopped
+                // container will never send the Unmount that would otherwise clear this
+                // ref, which would leave the volume permanently stuck "in use".
+                if container.State == "running" {
+                    if refs[mount.Name] == nil {
+                        refs[mount.Name] = map[string]bool{}
+                    }
+                    refs[mount.Name][container.ID] = true
+                }
             }
         }
     }
@@ -238,31 +463,95 @@ func (driver localPersistDriver) findExistingVolumesFromDockerDaemon() (error, m
             fmt.Print("Attempting to load from file state...   ")
         }
 
-        return driver.findExistingVolumesFromStateFile()
+        err, volumes, refs, _, _ := driver.findExistingVolumesFromStateFile()
+        return err, volumes, refs
     }
 
-    return nil, volumes
+    return nil, volumes, refs
 }
 
-func (driver localPersistDriver) findExistingVolumesFromStateFile() (error, map[string]string) {
+// findExistingVolumesFromStateFile reads the state file as-is, whatever version it was
+// written with. An older file simply has no "version"/"refs"/"opts"/"templates" keys,
+// which unmarshal cleanly into a zero version and nil maps, so loading it needs no
+// separate migration path for those. Versions before 5 did store bare/relative
+// mountpoints in "state" though, so those are joined against baseDir here to become
+// the absolute paths the rest of the driver now expects.
+func (driver localPersistDriver) findExistingVolumesFromStateFile() (error, map[string]string, map[string]map[string]bool, map[string]volumeOptions, map[string]string) {
     path := path.Join(driver.stateDir, driver.name + ".json")
     fileData, err := ioutil.ReadFile(path)
     if err != nil {
-        return err, map[string]string{}
+        return err, map[string]string{}, map[string]map[string]bool{}, map[string]volumeOptions{}, map[string]string{}
     }
 
     var data saveData
     e := json.Unmarshal(fileData, &data)
     if e != nil {
-        return e, map[string]string{}
+        return e, map[string]string{}, map[string]map[string]bool{}, map[string]volumeOptions{}, map[string]string{}
+    }
+
+    if data.State == nil {
+        data.State = map[string]string{}
+    }
+    if data.Refs == nil {
+        data.Refs = map[string]map[string]bool{}
+    }
+    if data.Opts == nil {
+        data.Opts = map[string]volumeOptions{}
+    }
+    if data.Templates == nil {
+        data.Templates = map[string]string{}
+    }
+
+    if data.Version < 5 {
+        // Pre-v5 Create always built realMountpoint via path.Join(baseDir, mountpoint),
+        // with no special-casing of an absolute-looking mountpoint - it was joined (and
+        // thus nested under baseDir) regardless. Mirror that exactly here rather than
+        // branching on filepath.IsAbs, which would wrongly treat a legacy leading-slash
+        // mountpoint as already resolved.
+        for name, mountpoint := range data.State {
+            data.State[name] = filepath.Join(driver.baseDir, mountpoint)
+        }
     }
 
-    return nil, data.State
+    return nil, data.State, data.Refs, data.Opts, data.Templates
+}
+
+// reconcileRefsFromDockerDaemon re-registers active mounts after a restart (of the
+// plugin or the Docker daemon) by inspecting running containers, mirroring moby's
+// live-restore fix where volume refs were otherwise lost and an in-use volume could
+// be removed out from under a container. The original per-Mount ID isn't retrievable
+// from container inspect, so the container ID is used as a stand-in ref key.
+func (driver localPersistDriver) reconcileRefsFromDockerDaemon() {
+    err, _, refs := driver.findExistingVolumesFromDockerDaemon()
+    if err != nil || len(refs) == 0 {
+        return
+    }
+
+    driver.mutex.Lock()
+    defer driver.mutex.Unlock()
+
+    for name, ids := range refs {
+        if driver.refs[name] == nil {
+            driver.refs[name] = map[string]bool{}
+        }
+        for id := range ids {
+            driver.refs[name][id] = true
+        }
+    }
+
+    e := driver.saveState()
+    if e != nil {
+        fmt.Println(e.Error())
+    }
 }
 
-func (driver localPersistDriver) saveState(volumes map[string]string) error {
+func (driver localPersistDriver) saveState() error {
     data := saveData{
-        State: volumes,
+        Version   : currentStateVersion,
+        State     : driver.volumes,
+        Refs      : driver.refs,
+        Opts      : driver.opts,
+        Templates : driver.templates,
     }
 
     fileData, err := json.Marshal(data)
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "fmt"
+    "flag"
+
+    "github.com/docker/go-plugins-helpers/volume"
+)
+
+const pluginName = "local-persist"
+
+var (
+    mountsDir  = flag.String("mountsDir", "/var/lib/docker/local-persist/volumes", "The base path where volume directories will be created")
+    stateDir   = flag.String("stateDir", "/var/lib/docker/local-persist/state", "The base path where the state file will be saved")
+    scope      = flag.String("scope", "local", "The scope advertised to the Docker daemon (\"local\" or \"global\")")
+    debug      = flag.Bool("debug", false, "Enable debug logging")
+    native     = flag.Bool("native", false, "Serve the Docker Volume Plugin protocol directly over a Unix socket instead of using go-plugins-helpers")
+    socketPath = flag.String("socketPath", "/run/docker/plugins/local-persist.sock", "The Unix socket path to serve on when running with --native")
+    allowPaths allowPathFlag
+)
+
+func init() {
+    flag.Var(&allowPaths, "allow-path", "An additional host subtree under which volumes may be created, besides mountsDir (repeatable)")
+}
+
+// allowPathFlag collects repeated -allow-path flags into a slice.
+type allowPathFlag []string
+
+func (a *allowPathFlag) String() string {
+    return fmt.Sprintf("%v", []string(*a))
+}
+
+func (a *allowPathFlag) Set(value string) error {
+    *a = append(*a, value)
+    return nil
+}
+
+func main() {
+    flag.Parse()
+
+    if *scope != "local" && *scope != "global" {
+        fmt.Printf("Invalid scope %q, must be \"local\" or \"global\"\n", *scope)
+        return
+    }
+
+    driver := newLocalPersistDriver(pluginName, *mountsDir, *stateDir, *scope, []string(allowPaths), *debug)
+
+    if *native {
+        if err := writeSpecFile(pluginName, *socketPath); err != nil {
+            fmt.Println(err.Error())
+        }
+
+        server := newPluginServer(driver)
+        fmt.Println(server.Serve(*socketPath))
+        return
+    }
+
+    h := volume.NewHandler(driver)
+    fmt.Println(h.ServeUnix("root", pluginName))
+}
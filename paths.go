@@ -0,0 +1,76 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// resolveSafeMountpoint turns a `Create` mountpoint option into an absolute host path,
+// rejecting anything that would land outside baseDir (or one of the operator-approved
+// allowedPaths) via ".." traversal, an absolute path escape, or a symlink swapped in
+// after the fact.
+func (driver localPersistDriver) resolveSafeMountpoint(mountpoint string) (string, error) {
+    var realMountpoint string
+    if filepath.IsAbs(mountpoint) {
+        realMountpoint = filepath.Clean(mountpoint)
+    } else {
+        realMountpoint = filepath.Clean(filepath.Join(driver.baseDir, mountpoint))
+    }
+
+    roots := append([]string{driver.baseDir}, driver.allowedPaths...)
+
+    if !pathIsWithinRoots(realMountpoint, roots) {
+        return "", fmt.Errorf("The mountpoint %s is outside of the allowed path(s)", realMountpoint)
+    }
+
+    // Resolve the roots themselves before comparing against a resolved descendant -
+    // baseDir/allowedPaths are commonly symlinks (e.g. pointing at a separate disk),
+    // and comparing a resolved path against an unresolved root would reject those too.
+    resolvedRoots := make([]string, len(roots))
+    for i, root := range roots {
+        resolvedRoot, err := filepath.EvalSymlinks(root)
+        if err != nil {
+            resolvedRoot = filepath.Clean(root)
+        }
+        resolvedRoots[i] = resolvedRoot
+    }
+
+    resolved, err := resolveExistingAncestor(realMountpoint)
+    if err == nil && !pathIsWithinRoots(resolved, resolvedRoots) {
+        return "", fmt.Errorf("The mountpoint %s escapes the allowed path(s) via a symlink", realMountpoint)
+    }
+
+    return realMountpoint, nil
+}
+
+func pathIsWithinRoots(p string, roots []string) bool {
+    for _, root := range roots {
+        rel, err := filepath.Rel(root, p)
+        if err != nil {
+            continue
+        }
+        if rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))) {
+            return true
+        }
+    }
+    return false
+}
+
+// resolveExistingAncestor resolves symlinks on the nearest ancestor of p that actually
+// exists on disk, since p itself (the not-yet-created mountpoint) can't be resolved.
+func resolveExistingAncestor(p string) (string, error) {
+    dir := p
+    for {
+        resolved, err := filepath.EvalSymlinks(dir)
+        if err == nil {
+            return resolved, nil
+        }
+        parent := filepath.Dir(dir)
+        if parent == dir {
+            return "", err
+        }
+        dir = parent
+    }
+}
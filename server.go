@@ -0,0 +1,95 @@
+package main
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "os"
+    "os/signal"
+    "path"
+    "syscall"
+
+    "github.com/docker/go-plugins-helpers/volume"
+)
+
+// pluginContentType is the media type the Docker Volume Plugin protocol expects
+// on every response, regardless of which transport serves it.
+const pluginContentType = "application/vnd.docker.plugins.v1.1+json"
+
+// pluginServer speaks the Docker Volume Plugin JSON protocol directly over a Unix
+// socket, so localPersistDriver can run without the go-plugins-helpers shim - useful
+// for running as a non-root user with a user-selectable socket path.
+type pluginServer struct {
+    driver   localPersistDriver
+    listener net.Listener
+}
+
+func newPluginServer(driver localPersistDriver) *pluginServer {
+    return &pluginServer{ driver: driver }
+}
+
+// Serve listens on socketPath and blocks handling requests until the listener is
+// closed, which happens automatically on SIGTERM/SIGINT.
+func (s *pluginServer) Serve(socketPath string) error {
+    os.Remove(socketPath)
+
+    listener, err := net.Listen("unix", socketPath)
+    if err != nil {
+        return err
+    }
+    s.listener = listener
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/Plugin.Activate", s.activate)
+    mux.HandleFunc("/VolumeDriver.Create", s.endpoint(s.driver.Create))
+    mux.HandleFunc("/VolumeDriver.Get", s.endpoint(s.driver.Get))
+    mux.HandleFunc("/VolumeDriver.List", s.endpoint(s.driver.List))
+    mux.HandleFunc("/VolumeDriver.Remove", s.endpoint(s.driver.Remove))
+    mux.HandleFunc("/VolumeDriver.Path", s.endpoint(s.driver.Path))
+    mux.HandleFunc("/VolumeDriver.Mount", s.endpoint(s.driver.Mount))
+    mux.HandleFunc("/VolumeDriver.Unmount", s.endpoint(s.driver.Unmount))
+    mux.HandleFunc("/VolumeDriver.Capabilities", s.endpoint(s.driver.Capabilities))
+
+    go s.shutdownOnSignal(socketPath)
+
+    return http.Serve(listener, mux)
+}
+
+func (s *pluginServer) activate(w http.ResponseWriter, r *http.Request) {
+    s.writeJSON(w, map[string][]string{ "Implements": {"VolumeDriver"} })
+}
+
+// endpoint wraps one of the driver's Request/Response methods as an HTTP handler,
+// decoding the plugin protocol's JSON body and re-encoding the driver's response.
+func (s *pluginServer) endpoint(fn func(volume.Request) volume.Response) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req volume.Request
+        if r.Body != nil {
+            defer r.Body.Close()
+            json.NewDecoder(r.Body).Decode(&req)
+        }
+        s.writeJSON(w, fn(req))
+    }
+}
+
+func (s *pluginServer) writeJSON(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", pluginContentType)
+    json.NewEncoder(w).Encode(v)
+}
+
+func (s *pluginServer) shutdownOnSignal(socketPath string) {
+    sigCh := make(chan os.Signal, 1)
+    signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+    <-sigCh
+
+    s.listener.Close()
+    os.Remove(socketPath)
+}
+
+// writeSpecFile drops a spec file pointing at socketPath, the same mechanism the
+// Docker daemon uses to discover plugins that aren't registered via the plugin API.
+func writeSpecFile(name string, socketPath string) error {
+    specPath := path.Join("/etc/docker/plugins", name + ".spec")
+    return ioutil.WriteFile(specPath, []byte("unix://" + socketPath), 0644)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "bytes"
+    "crypto/rand"
+    "fmt"
+    "os"
+    "strings"
+    "text/template"
+    "time"
+)
+
+// mountpointContext is the value `mountpoint` templates are executed against, e.g.
+// `/data/{{.Name}}/{{.Env "NODE_ID"}}/{{.Date "2006-01-02"}}`.
+type mountpointContext struct {
+    Name string
+}
+
+func (c mountpointContext) Env(key string) string {
+    return os.Getenv(key)
+}
+
+func (c mountpointContext) Hostname() string {
+    hostname, _ := os.Hostname()
+    return hostname
+}
+
+func (c mountpointContext) Date(layout string) string {
+    return time.Now().Format(layout)
+}
+
+func (c mountpointContext) UUID() string {
+    b := make([]byte, 16)
+    rand.Read(b)
+    b[6] = (b[6] & 0x0f) | 0x40
+    b[8] = (b[8] & 0x3f) | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// resolveMountpointTemplate renders mountpoint as a text/template against name when it
+// looks templated (contains "{{"), so a single `mountpoint` option in a compose/stack
+// file can expand to a distinct path per volume/node instead of requiring every
+// `docker volume create` to pass a unique explicit path.
+func resolveMountpointTemplate(mountpoint string, name string) (string, error) {
+    if !strings.Contains(mountpoint, "{{") {
+        return mountpoint, nil
+    }
+
+    t, err := template.New("mountpoint").Parse(mountpoint)
+    if err != nil {
+        return "", fmt.Errorf("Invalid `mountpoint` template: %s", err.Error())
+    }
+
+    var buf bytes.Buffer
+    if err := t.Execute(&buf, mountpointContext{ Name: name }); err != nil {
+        return "", fmt.Errorf("Could not resolve `mountpoint` template: %s", err.Error())
+    }
+
+    return buf.String(), nil
+}